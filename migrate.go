@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	pg "gopkg.in/pg.v4"
+)
+
+const migrationName = "sample_data"
+
+func getTablePrimaryKeyColumns(db *pg.DB, table string) ([]string, error) {
+	var model []struct {
+		Colname string
+	}
+	sql := `
+		SELECT a.attname AS colname
+		FROM pg_catalog.pg_index i
+		JOIN pg_catalog.pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = ?::regclass AND i.indisprimary
+		ORDER BY a.attnum
+	`
+	_, err := db.Query(&model, sql, table)
+	if err != nil {
+		return nil, err
+	}
+
+	cols := make([]string, 0, len(model))
+	for _, v := range model {
+		cols = append(cols, v.Colname)
+	}
+	return cols, nil
+}
+
+// dumpMigration writes a golang-migrate compatible up/down migration pair
+// to outDir: `0001_sample_data.up.sql` holds the INSERT statements for every
+// table in the manifest, and `0001_sample_data.down.sql` holds the matching
+// `DELETE ... WHERE <pk> IN (...)` statements, in reverse dependency order.
+func dumpMigration(db *pg.DB, manifest *Manifest, outDir string) error {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	iterator := NewManifestIterator(db, manifest)
+	items := make([]*ManifestItem, 0)
+	for {
+		v, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			break
+		}
+		items = append(items, v)
+	}
+
+	cache := newSampleCache()
+	closures, err := buildReferentialClosures(db, manifest, items, cache)
+	if err != nil {
+		return err
+	}
+
+	upFile, err := os.Create(filepath.Join(outDir, fmt.Sprintf("0001_%s.up.sql", migrationName)))
+	if err != nil {
+		return err
+	}
+	defer upFile.Close()
+
+	downStatements := make([]string, 0, len(items))
+
+	for _, v := range items {
+		cols := v.Columns
+		if len(cols) == 0 {
+			cols, err = getTableCols(db, v.Table)
+			if err != nil {
+				return err
+			}
+		}
+
+		source, err := resolveRowSource(db, manifest, v, closures, cache)
+		if err != nil {
+			return err
+		}
+
+		// A derived query isn't a real relation, so there's no primary key
+		// to look up; such tables are skipped in the down migration.
+		pkCols := []string{}
+		if v.Query == "" {
+			pkCols, err = getTablePrimaryKeyColumns(db, v.Table)
+			if err != nil {
+				return err
+			}
+		}
+
+		down, err := dumpTableMigration(upFile, db, v, source, cols, pkCols)
+		if err != nil {
+			return err
+		}
+		if down != "" {
+			downStatements = append(downStatements, down)
+		}
+
+		for _, sql := range v.PostActions {
+			dumpSqlCmd(upFile, sql)
+		}
+	}
+
+	downFile, err := os.Create(filepath.Join(outDir, fmt.Sprintf("0001_%s.down.sql", migrationName)))
+	if err != nil {
+		return err
+	}
+	defer downFile.Close()
+
+	for i := len(downStatements) - 1; i >= 0; i-- {
+		fmt.Fprint(downFile, downStatements[i])
+	}
+
+	return nil
+}
+
+// dumpTableMigration writes one table's rows as an INSERT statement to upW
+// and returns the DELETE statement that undoes it, keyed on the table's
+// primary key values actually dumped. Returns an empty string if the table
+// has no usable primary key or no rows were dumped.
+func dumpTableMigration(upW io.Writer, db *pg.DB, v *ManifestItem, source string, columns []string, pkCols []string) (string, error) {
+	pkIdx := make([]int, 0, len(pkCols))
+	for _, pk := range pkCols {
+		for i, c := range columns {
+			if c == pk {
+				pkIdx = append(pkIdx, i)
+				break
+			}
+		}
+	}
+	// A primary key only partly covered by the dumped columns is not usable.
+	if len(pkIdx) != len(pkCols) {
+		pkIdx = pkIdx[:0]
+	}
+
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = strconv.Quote(c)
+	}
+	colList := strings.Join(quoted, ", ")
+
+	fmt.Fprintf(upW, "\n-- Data for Name: %s; Type: TABLE DATA\n", v.Table)
+
+	rows := make([]string, 0)
+	pkTuples := make([]string, 0)
+
+	err := dumpRows(db, v, source, columns, func(values []string, nulls []bool) error {
+		row := make([]string, len(values))
+		for i, value := range values {
+			row[i] = sqlLiteral(value, nulls[i])
+		}
+		rows = append(rows, "("+strings.Join(row, ", ")+")")
+
+		if len(pkIdx) == 0 {
+			return nil
+		}
+		tuple := make([]string, len(pkIdx))
+		for i, idx := range pkIdx {
+			tuple[i] = sqlLiteral(values[idx], nulls[idx])
+		}
+		if len(tuple) == 1 {
+			pkTuples = append(pkTuples, tuple[0])
+		} else {
+			pkTuples = append(pkTuples, "("+strings.Join(tuple, ", ")+")")
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(rows) > 0 {
+		fmt.Fprintf(upW, "\nINSERT INTO %s (%s) VALUES\n\t%s;\n", v.Table, colList, strings.Join(rows, ",\n\t"))
+	}
+
+	if len(pkTuples) == 0 {
+		return "", nil
+	}
+
+	pkExpr := strconv.Quote(pkCols[0])
+	if len(pkCols) > 1 {
+		quotedPk := make([]string, len(pkCols))
+		for i, c := range pkCols {
+			quotedPk[i] = strconv.Quote(c)
+		}
+		pkExpr = "(" + strings.Join(quotedPk, ", ") + ")"
+	}
+
+	return fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s);\n", v.Table, pkExpr, strings.Join(pkTuples, ", ")), nil
+}
+
+// applyMigration connects to the target database URL and executes upSQL,
+// recording the migration in a `schema_migrations` table the way
+// golang-migrate's Postgres driver does.
+func applyMigration(targetURL string, upSQL string) error {
+	db, err := connectMigrateTarget(targetURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL PRIMARY KEY,
+			dirty boolean NOT NULL
+		)
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(upSQL); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO schema_migrations (version, dirty) VALUES (1, FALSE)
+		ON CONFLICT (version) DO UPDATE SET dirty = FALSE
+	`)
+	return err
+}
+
+func connectMigrateTarget(targetURL string) (*pg.DB, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := u.Host
+	if !strings.Contains(addr, ":") {
+		addr = addr + ":5432"
+	}
+
+	password, _ := u.User.Password()
+	return pg.Connect(&pg.Options{
+		Addr:     addr,
+		User:     u.User.Username(),
+		Password: password,
+		Database: strings.TrimPrefix(u.Path, "/"),
+	}), nil
+}
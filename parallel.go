@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	pg "gopkg.in/pg.v4"
+)
+
+// openWorkerConnections opens jobs independent connections to the same
+// database as db, for use by makeDumpParallel's worker pool. When snapshot
+// is true every connection starts a REPEATABLE READ transaction and all but
+// the first are pinned to the first connection's exported snapshot via
+// pg_export_snapshot()/SET TRANSACTION SNAPSHOT, the same mechanism
+// `pg_dump -j` uses to give parallel workers a consistent point-in-time
+// view. The returned finish func must be called once dumping is done; it
+// commits the snapshot transactions (if any) and closes every connection.
+func openWorkerConnections(pgOpts *pg.Options, jobs int, snapshot bool) ([]*pg.DB, func(), error) {
+	conns := make([]*pg.DB, 0, jobs)
+	closeAll := func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+
+	for i := 0; i < jobs; i++ {
+		c, err := connectDB(pgOpts)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		conns = append(conns, c)
+	}
+
+	if !snapshot {
+		return conns, closeAll, nil
+	}
+
+	if _, err := conns[0].Exec("BEGIN ISOLATION LEVEL REPEATABLE READ"); err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+
+	var model []struct {
+		Snapshot string
+	}
+	if _, err := conns[0].Query(&model, `SELECT pg_export_snapshot() AS snapshot`); err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	if len(model) == 0 {
+		closeAll()
+		return nil, nil, fmt.Errorf("failed to export snapshot")
+	}
+	snapshotID := model[0].Snapshot
+
+	for _, c := range conns[1:] {
+		if _, err := c.Exec("BEGIN ISOLATION LEVEL REPEATABLE READ"); err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		if _, err := c.Exec(fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", snapshotID)); err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+	}
+
+	finish := func() {
+		for _, c := range conns {
+			c.Exec("COMMIT")
+		}
+		closeAll()
+	}
+	return conns, finish, nil
+}
+
+// computeLevels groups items into dependency levels: every item in level N
+// depends on at least one item in level N-1 (or is a root, at level 0) and
+// on nothing in its own or any later level. Items within the same level have
+// no dependency between them and can safely be dumped concurrently. items
+// must already be in the dependency order produced by ManifestIterator, so
+// that a dependency's level is always computed before its dependents.
+func computeLevels(db *pg.DB, items []*ManifestItem) ([][]*ManifestItem, error) {
+	levelOf := make(map[string]int, len(items))
+
+	levels := make([][]*ManifestItem, 0)
+	for _, v := range items {
+		deps, err := getTableDeps(db, v.Table)
+		if err != nil {
+			return nil, err
+		}
+
+		level := 0
+		for _, dep := range deps {
+			if l, ok := levelOf[dep]; ok && l+1 > level {
+				level = l + 1
+			}
+		}
+		levelOf[v.Table] = level
+
+		for len(levels) <= level {
+			levels = append(levels, nil)
+		}
+		levels[level] = append(levels[level], v)
+	}
+
+	return levels, nil
+}
+
+// makeDumpParallel is makeDump's worker-pool counterpart: it distributes
+// independent tables (one dependency level at a time) across jobs worker
+// connections, each of which renders its table into a private temp file via
+// the regular DumpFormatter, and then concatenates the finished temp files
+// into w in the same dependency order makeDump would have written them in.
+func makeDumpParallel(pgOpts *pg.Options, db *pg.DB, manifest *Manifest, w io.Writer, schemaMode string, formatter DumpFormatter, jobs int, snapshot bool) error {
+	iterator := NewManifestIterator(db, manifest)
+	items := make([]*ManifestItem, 0)
+	for {
+		v, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			break
+		}
+		items = append(items, v)
+	}
+
+	tables := make([]string, 0, len(items))
+	colsByTable := make(map[string][]string, len(items))
+	for _, v := range items {
+		tables = append(tables, v.Table)
+
+		cols := v.Columns
+		if len(cols) == 0 {
+			var err error
+			cols, err = getTableCols(db, v.Table)
+			if err != nil {
+				return err
+			}
+		}
+		colsByTable[v.Table] = cols
+	}
+
+	if err := formatter.Begin(w); err != nil {
+		return err
+	}
+
+	if schemaMode == SchemaPre || schemaMode == SchemaOnly {
+		if err := dumpSchema(w, db, tables); err != nil {
+			return err
+		}
+	}
+
+	if schemaMode != SchemaOnly {
+		conns, finish, err := openWorkerConnections(pgOpts, jobs, snapshot)
+		if err != nil {
+			return err
+		}
+		defer finish()
+
+		// Resolve referential closures (and the sample: {method: random or
+		// reservoir} pins they trigger) against conns[0] rather than db:
+		// with --snapshot, conns[0] is the connection every worker's
+		// REPEATABLE READ transaction is pinned to via
+		// pg_export_snapshot(), so any FK values or ctids baked in here
+		// must come from that same point-in-time view, not an earlier one
+		// db might see.
+		cache := newSampleCache()
+		closures, err := buildReferentialClosures(conns[0], manifest, items, cache)
+		if err != nil {
+			return err
+		}
+
+		levels, err := computeLevels(db, items)
+		if err != nil {
+			return err
+		}
+
+		connPool := make(chan *pg.DB, len(conns))
+		for _, c := range conns {
+			connPool <- c
+		}
+
+		paths := make(map[string]string, len(items))
+
+		for _, level := range levels {
+			var wg sync.WaitGroup
+			errs := make([]error, len(level))
+			results := make([]string, len(level))
+
+			for i, v := range level {
+				wg.Add(1)
+				go func(i int, v *ManifestItem) {
+					defer wg.Done()
+
+					conn := <-connPool
+					defer func() { connPool <- conn }()
+
+					path, err := dumpTableToFile(conn, manifest, v, colsByTable[v.Table], closures, cache, formatter)
+					if err != nil {
+						errs[i] = err
+						return
+					}
+					results[i] = path
+				}(i, v)
+			}
+			wg.Wait()
+
+			var levelErr error
+			for _, err := range errs {
+				if err != nil {
+					levelErr = err
+					break
+				}
+			}
+			if levelErr != nil {
+				for _, path := range results {
+					if path != "" {
+						os.Remove(path)
+					}
+				}
+				for _, path := range paths {
+					os.Remove(path)
+				}
+				return levelErr
+			}
+
+			for i, v := range level {
+				paths[v.Table] = results[i]
+			}
+		}
+
+		for _, v := range items {
+			path := paths[v.Table]
+			if err := appendTableFile(w, path); err != nil {
+				return err
+			}
+
+			for _, sql := range v.PostActions {
+				dumpSqlCmd(w, sql)
+			}
+		}
+	}
+
+	if schemaMode == SchemaPre || schemaMode == SchemaOnly {
+		if err := dumpSequenceRestarts(w, db, tables); err != nil {
+			return err
+		}
+	}
+
+	return formatter.End(w)
+}
+
+// dumpTableToFile renders v's rows through formatter into a private temp
+// file using conn, so concurrent workers never contend on the shared dump
+// writer. The caller is responsible for removing the returned path once its
+// contents have been copied into the final output.
+func dumpTableToFile(conn *pg.DB, manifest *Manifest, v *ManifestItem, cols []string, closures map[string]*referentialClosure, cache *sampleCache, formatter DumpFormatter) (string, error) {
+	source, err := resolveRowSource(conn, manifest, v, closures, cache)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile("", fmt.Sprintf("pg_dump_sample_%s_", v.Table))
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+
+	if err := formatter.DumpTable(tmp, conn, v, source, cols); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// appendTableFile copies a worker's temp file into the final dump output
+// and removes it. For formatters that write their own per-table output
+// (e.g. csvFormatter) the temp file is simply empty.
+func appendTableFile(w io.Writer, path string) error {
+	defer os.Remove(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -6,11 +6,11 @@ import (
 	"io/ioutil"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
 
-	"github.com/cbroglie/mustache"
 	flags "github.com/jessevdk/go-flags"
 	"golang.org/x/crypto/ssh/terminal"
 	pg "gopkg.in/pg.v4"
@@ -67,18 +67,37 @@ type Options struct {
 	OutputFile   string
 	Database     string
 	UseTls       bool
+	Schema       string
+	Format       string
+	BatchSize    int
+	OutputDir    string
+	MigrateOut   string
+	MigrateApply string
+	Jobs         int
+	Snapshot     bool
 }
 
 type ManifestItem struct {
-	Table       string   `yaml:"table"`
-	Query       string   `yaml:"query"`
-	Columns     []string `yaml:"columns,flow"`
-	PostActions []string `yaml:"post_actions,flow"`
+	Table         string            `yaml:"table"`
+	Query         string            `yaml:"query"`
+	Columns       []string          `yaml:"columns,flow"`
+	PostActions   []string          `yaml:"post_actions,flow"`
+	Transforms    map[string]string `yaml:"transforms"`
+	Deterministic bool              `yaml:"deterministic"`
+	Limit         int               `yaml:"limit"`
+	Where         string            `yaml:"where"`
+	Sample        *SampleSpec       `yaml:"sample"`
+
+	// auto marks an item that wasn't present in the manifest file but was
+	// created to satisfy a foreign key dependency of another table, see
+	// ManifestIterator.Next. It is never set from YAML.
+	auto bool
 }
 
 type Manifest struct {
 	Vars   map[string]string `yaml:"vars"`
 	Tables []ManifestItem    `yaml:"tables"`
+	Schema string            `yaml:"schema"`
 }
 
 type ManifestIterator struct {
@@ -130,7 +149,7 @@ func (m *ManifestIterator) Next() (*ManifestItem, error) {
 		if !is_todo && !is_done {
 			// A new dependency table not present in the manifest file was
 			// found, create a default entry for it
-			m.todo[dep] = ManifestItem{Table: dep}
+			m.todo[dep] = ManifestItem{Table: dep, auto: true}
 		}
 		if _, ok := m.todo[dep]; ok && table != dep {
 			todoDeps = append(todoDeps, dep)
@@ -158,6 +177,14 @@ func parseArgs() (*Options, error) {
 		ManifestFile string `short:"m" long:"manifest-file" description:"path to manifest file"`
 		OutputFile   string `short:"f" long:"file" description:"path to output file"`
 		UseTls       bool   `short:"s" long:"tls" description:"use SSL/TLS database connection"`
+		Schema       string `long:"schema" choice:"none" choice:"pre" choice:"only" default:"none" description:"dump schema DDL and sequence restarts: none, pre (before data) or only (no data)"`
+		Format       string `long:"format" choice:"copy" choice:"insert" choice:"csv" choice:"jsonl" default:"copy" description:"output format: copy, insert, csv or jsonl"`
+		BatchSize    int    `long:"batch-size" default:"100" description:"rows per INSERT statement when --format=insert"`
+		OutputDir    string `long:"output-dir" description:"directory for per-table files when --format=csv"`
+		MigrateOut   string `long:"migrate-out" description:"write a golang-migrate up/down migration pair to this directory instead of a single dump"`
+		MigrateApply string `long:"migrate-apply" description:"apply the generated up migration to this database URL"`
+		Jobs         int    `short:"j" long:"jobs" default:"1" description:"dump this many tables in parallel, each over its own connection"`
+		Snapshot     bool   `long:"snapshot" description:"with --jobs, give every worker connection a consistent point-in-time view via pg_export_snapshot()"`
 		Help         bool   `long:"help" description:"show help"`
 	}
 
@@ -204,6 +231,11 @@ func parseArgs() (*Options, error) {
 		return nil, fmt.Errorf("port must be a number 0-65535")
 	}
 
+	if opts.Jobs < 1 {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("--jobs must be at least 1")
+	}
+
 	return &Options{
 		Host:         opts.Host,
 		Port:         port,
@@ -212,6 +244,14 @@ func parseArgs() (*Options, error) {
 		ManifestFile: opts.ManifestFile,
 		OutputFile:   opts.OutputFile,
 		UseTls:       opts.UseTls,
+		Schema:       opts.Schema,
+		Format:       opts.Format,
+		BatchSize:    opts.BatchSize,
+		OutputDir:    opts.OutputDir,
+		MigrateOut:   opts.MigrateOut,
+		MigrateApply: opts.MigrateApply,
+		Jobs:         opts.Jobs,
+		Snapshot:     opts.Snapshot,
 		Database:     args[0],
 	}, nil
 }
@@ -253,15 +293,25 @@ func dumpSqlCmd(w io.Writer, v string) {
 	fmt.Fprintf(w, SQL_CMD_DUMP, v)
 }
 
-func dumpTable(w io.Writer, db *pg.DB, table string) error {
-	sql := fmt.Sprintf(`COPY %s TO STDOUT`, table)
+func dumpTable(w io.Writer, db *pg.DB, source string, columns []string, transforms map[string]string, deterministic bool, sample *SampleSpec) error {
+	sql := fmt.Sprintf(`COPY %s TO STDOUT`, source)
 
-	_, err := db.CopyTo(w, sql)
+	parsed, err := buildTransforms(transforms)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	var dest io.Writer = w
+	if len(parsed) > 0 {
+		dest = newTransformWriter(w, columns, parsed, deterministic)
+	}
+	dest = wrapReservoir(dest, sample)
+
+	if _, err := db.CopyTo(dest, sql); err != nil {
+		return err
+	}
+
+	return flushWriter(dest)
 }
 
 func readPassword(username string) (string, error) {
@@ -333,10 +383,9 @@ func getTableDeps(db *pg.DB, table string) ([]string, error) {
 	return tables, nil
 }
 
-func makeDump(db *pg.DB, manifest *Manifest, w io.Writer) error {
-	beginDump(w)
-
+func makeDump(db *pg.DB, manifest *Manifest, w io.Writer, schemaMode string, formatter DumpFormatter) error {
 	iterator := NewManifestIterator(db, manifest)
+	items := make([]*ManifestItem, 0)
 	for {
 		v, err := iterator.Next()
 		if err != nil {
@@ -345,42 +394,63 @@ func makeDump(db *pg.DB, manifest *Manifest, w io.Writer) error {
 		if v == nil {
 			break
 		}
+		items = append(items, v)
+	}
 
-		cols := v.Columns
-		if len(cols) == 0 {
-			cols, err = getTableCols(db, v.Table)
-			if err != nil {
-				return err
-			}
+	tables := make([]string, 0, len(items))
+	for _, v := range items {
+		tables = append(tables, v.Table)
+	}
+
+	cache := newSampleCache()
+	closures, err := buildReferentialClosures(db, manifest, items, cache)
+	if err != nil {
+		return err
+	}
+
+	if err := formatter.Begin(w); err != nil {
+		return err
+	}
+
+	if schemaMode == SchemaPre || schemaMode == SchemaOnly {
+		if err := dumpSchema(w, db, tables); err != nil {
+			return err
 		}
+	}
 
-		beginTable(w, v.Table, cols)
-		if v.Query == "" {
-			err := dumpTable(w, db, v.Table)
-			if err != nil {
-				return err
+	if schemaMode != SchemaOnly {
+		for _, v := range items {
+			cols := v.Columns
+			if len(cols) == 0 {
+				var err error
+				cols, err = getTableCols(db, v.Table)
+				if err != nil {
+					return err
+				}
 			}
-		} else {
-			query, err := mustache.Render(v.Query, manifest.Vars)
+
+			source, err := resolveRowSource(db, manifest, v, closures, cache)
 			if err != nil {
 				return err
 			}
 
-			err = dumpTable(w, db, fmt.Sprintf("(%s)", query))
-			if err != nil {
+			if err := formatter.DumpTable(w, db, v, source, cols); err != nil {
 				return err
 			}
-		}
-		endTable(w)
 
-		for _, sql := range v.PostActions {
-			dumpSqlCmd(w, sql)
+			for _, sql := range v.PostActions {
+				dumpSqlCmd(w, sql)
+			}
 		}
 	}
 
-	endDump(w)
+	if schemaMode == SchemaPre || schemaMode == SchemaOnly {
+		if err := dumpSequenceRestarts(w, db, tables); err != nil {
+			return err
+		}
+	}
 
-	return nil
+	return formatter.End(w)
 }
 
 func main() {
@@ -415,12 +485,13 @@ func main() {
 	}
 
 	// Connect to the DB
-	db, err := connectDB(&pg.Options{
+	pgOpts := &pg.Options{
 		Addr:     fmt.Sprintf("%s:%d", opts.Host, opts.Port),
 		Database: opts.Database,
 		SSL:      opts.UseTls,
 		User:     opts.Username,
-	})
+	}
+	db, err := connectDB(pgOpts)
 	if err != nil {
 		password := ""
 		if !opts.NoPassword {
@@ -433,21 +504,59 @@ func main() {
 		}
 
 		// Try again, this time with password
-		db, err = connectDB(&pg.Options{
+		pgOpts = &pg.Options{
 			Addr:     fmt.Sprintf("%s:%d", opts.Host, opts.Port),
 			Database: opts.Database,
 			SSL:      opts.UseTls,
 			User:     opts.Username,
 			Password: password,
-		})
+		}
+		db, err = connectDB(pgOpts)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 	}
 
+	if opts.MigrateOut != "" {
+		if err := dumpMigration(db, manifest, opts.MigrateOut); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if opts.MigrateApply != "" {
+			upSQL, err := ioutil.ReadFile(filepath.Join(opts.MigrateOut, fmt.Sprintf("0001_%s.up.sql", migrationName)))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			if err := applyMigration(opts.MigrateApply, string(upSQL)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		return
+	}
+
+	// The manifest's `schema:` entry overrides the --schema flag.
+	schemaMode := opts.Schema
+	if manifest.Schema != "" {
+		schemaMode = manifest.Schema
+	}
+
+	formatter, err := newDumpFormatter(opts.Format, opts.BatchSize, opts.OutputDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Make the dump
-	err = makeDump(db, manifest, output)
+	if opts.Jobs > 1 {
+		err = makeDumpParallel(pgOpts, db, manifest, output, schemaMode, formatter, opts.Jobs, opts.Snapshot)
+	} else {
+		err = makeDump(db, manifest, output, schemaMode, formatter)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
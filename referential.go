@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pg "gopkg.in/pg.v4"
+)
+
+// referentialClosure narrows an auto-generated parent ManifestItem down to
+// only the primary key values actually referenced by the child rows that
+// pulled it into the dump, instead of dumping the whole parent table.
+type referentialClosure struct {
+	column   string
+	values   map[string]bool
+	resolved bool
+}
+
+// getTableForeignKey returns the child and parent column of one foreign key
+// linking childTable to parentTable, or two empty strings if there isn't
+// one. For a multi-column foreign key only its first column pair is
+// returned.
+func getTableForeignKey(db *pg.DB, childTable string, parentTable string) (string, string, error) {
+	var model []struct {
+		Childcol  string
+		Parentcol string
+	}
+	sql := `
+		SELECT
+			(SELECT attname FROM pg_catalog.pg_attribute WHERE attrelid = c.conrelid AND attnum = c.conkey[1]) AS childcol,
+			(SELECT attname FROM pg_catalog.pg_attribute WHERE attrelid = c.confrelid AND attnum = c.confkey[1]) AS parentcol
+		FROM pg_catalog.pg_constraint c
+		WHERE c.conrelid = ?::regclass AND c.confrelid = ?::regclass AND c.contype = 'f'
+		LIMIT 1
+	`
+	_, err := db.Query(&model, sql, childTable, parentTable)
+	if err != nil {
+		return "", "", err
+	}
+	if len(model) == 0 {
+		return "", "", nil
+	}
+	return model[0].Childcol, model[0].Parentcol, nil
+}
+
+// collectReferencedValues runs the child's own row source and returns the
+// distinct values of its foreign key column, as text, so they can be
+// spliced into the parent's restricting query regardless of the column's
+// actual type.
+func collectReferencedValues(db *pg.DB, source string, column string) ([]string, error) {
+	var model []struct {
+		Val *string
+	}
+	sql := fmt.Sprintf("SELECT DISTINCT (%s)::text AS val FROM %s src", strconv.Quote(column), source)
+	_, err := db.Query(&model, sql)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]string, 0, len(model))
+	for _, v := range model {
+		if v.Val != nil {
+			values = append(values, *v.Val)
+		}
+	}
+	return values, nil
+}
+
+// buildReferentialClosures inspects every explicit (non-auto-added) item's
+// foreign keys and, for each one pointing at an auto-added parent item,
+// folds the child's referenced primary key values into that parent's
+// closure. Explicit items with a custom `query` are not inspected.
+// Auto-added items that no explicit child constrains fall back to a full
+// dump, same as before this feature existed.
+//
+// cache is the same sampleCache later passed to resolveRowSource for the
+// item's own data dump, so a child using sample: {method: random} or
+// sample: {method: reservoir} has its row source resolved once and shared
+// between this closure pass and the dump pass instead of being re-sampled.
+func buildReferentialClosures(db *pg.DB, manifest *Manifest, items []*ManifestItem, cache *sampleCache) (map[string]*referentialClosure, error) {
+	itemByTable := make(map[string]*ManifestItem, len(items))
+	for _, v := range items {
+		itemByTable[v.Table] = v
+	}
+
+	closures := make(map[string]*referentialClosure)
+
+	for _, v := range items {
+		if v.auto || v.Query != "" {
+			continue
+		}
+
+		deps, err := getTableDeps(db, v.Table)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dep := range deps {
+			parent, ok := itemByTable[dep]
+			if !ok || !parent.auto {
+				continue
+			}
+
+			childCol, parentCol, err := getTableForeignKey(db, v.Table, dep)
+			if err != nil {
+				return nil, err
+			}
+			if childCol == "" {
+				continue
+			}
+
+			source, err := buildRowSource(db, manifest, v, cache)
+			if err != nil {
+				return nil, err
+			}
+
+			values, err := collectReferencedValues(db, source, childCol)
+			if err != nil {
+				return nil, err
+			}
+
+			c, ok := closures[dep]
+			if !ok {
+				c = &referentialClosure{column: parentCol, values: make(map[string]bool)}
+				closures[dep] = c
+			}
+			c.resolved = true
+			for _, val := range values {
+				c.values[val] = true
+			}
+		}
+	}
+
+	return closures, nil
+}
+
+// resolveRowSource is like buildRowSource but additionally narrows an
+// auto-added parent item down to its referential closure, if one was built.
+func resolveRowSource(db *pg.DB, manifest *Manifest, v *ManifestItem, closures map[string]*referentialClosure, cache *sampleCache) (string, error) {
+	if c, ok := closures[v.Table]; ok && c.resolved {
+		return buildClosureSource(v.Table, c), nil
+	}
+	return buildRowSource(db, manifest, v, cache)
+}
+
+func buildClosureSource(table string, c *referentialClosure) string {
+	if len(c.values) == 0 {
+		return fmt.Sprintf("(SELECT * FROM %s WHERE FALSE)", table)
+	}
+
+	values := make([]string, 0, len(c.values))
+	for val := range c.values {
+		values = append(values, sqlLiteral(val, false))
+	}
+	return fmt.Sprintf("(SELECT * FROM %s WHERE %s::text = ANY(ARRAY[%s]))", table, strconv.Quote(c.column), strings.Join(values, ", "))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/cbroglie/mustache"
+	pg "gopkg.in/pg.v4"
+)
+
+// SampleSpec configures row sampling for a manifest item: `method: random`
+// is pushed down to the database as `ORDER BY random() LIMIT size`, while
+// `method: reservoir` streams every matching row through Algorithm R so
+// tables too large to sort can still be sampled in a single pass.
+type SampleSpec struct {
+	Method string `yaml:"method"`
+	Size   int    `yaml:"size"`
+}
+
+// buildRowSource returns the `COPY (...) TO STDOUT`-able SQL expression
+// selecting the rows for this manifest item: its literal `query` if given,
+// otherwise `table` constrained by `where`/`limit`/`sample`.
+//
+// `sample: {method: random}` and `sample: {method: reservoir}` are both
+// resolved through cache instead of being re-sampled on every call: the
+// former re-randomizes `ORDER BY random() LIMIT size` on every execution,
+// and the latter's Algorithm R pass (see reservoirSampler) draws a fresh
+// sample every time it runs, while this item's source is evaluated twice -
+// once to build a referencing child's FK closure (see
+// buildReferentialClosures) and again for the item's own data dump - which
+// would otherwise silently hand each pass a different set of rows.
+func buildRowSource(db *pg.DB, manifest *Manifest, v *ManifestItem, cache *sampleCache) (string, error) {
+	if v.Query != "" {
+		query, err := mustache.Render(v.Query, manifest.Vars)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s)", query), nil
+	}
+
+	if isRandomSample(v.Sample) {
+		return cache.resolve(v.Table, func() (string, error) { return pinRandomSample(db, v) })
+	}
+	if isReservoirSample(v.Sample) {
+		return cache.resolve(v.Table, func() (string, error) { return pinReservoirSample(db, v) })
+	}
+
+	if v.Where == "" && v.Limit <= 0 {
+		return v.Table, nil
+	}
+
+	sql := fmt.Sprintf("SELECT * FROM %s", v.Table)
+	if v.Where != "" {
+		sql += fmt.Sprintf(" WHERE %s", v.Where)
+	}
+	if v.Limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", v.Limit)
+	}
+
+	return fmt.Sprintf("(%s)", sql), nil
+}
+
+// pinnedSource restricts table to exactly the given ctids, or to no rows at
+// all if ctids is empty. It's how both pinRandomSample and
+// pinReservoirSample freeze a one-off sample into a source that can be
+// queried repeatedly without drawing a new sample each time.
+func pinnedSource(table string, ctids []string) string {
+	if len(ctids) == 0 {
+		return fmt.Sprintf("(SELECT * FROM %s WHERE FALSE)", table)
+	}
+
+	quoted := make([]string, len(ctids))
+	for i, ctid := range ctids {
+		quoted[i] = "'" + ctid + "'"
+	}
+	return fmt.Sprintf("(SELECT * FROM %s WHERE ctid = ANY(ARRAY[%s]::tid[]))", table, strings.Join(quoted, ", "))
+}
+
+// pinRandomSample runs v's `sample: {method: random}` query once and pins
+// the rows it picked by ctid, so every later reference to v's row source
+// (see buildRowSource) sees that exact same set of rows instead of a fresh
+// random draw.
+func pinRandomSample(db *pg.DB, v *ManifestItem) (string, error) {
+	var model []struct {
+		Ctid string
+	}
+	sql := fmt.Sprintf("SELECT ctid::text AS ctid FROM %s", v.Table)
+	if v.Where != "" {
+		sql += fmt.Sprintf(" WHERE %s", v.Where)
+	}
+	sql += fmt.Sprintf(" ORDER BY random() LIMIT %d", v.Sample.Size)
+
+	_, err := db.Query(&model, sql)
+	if err != nil {
+		return "", err
+	}
+
+	ctids := make([]string, len(model))
+	for i, row := range model {
+		ctids[i] = row.Ctid
+	}
+	return pinnedSource(v.Table, ctids), nil
+}
+
+// pinReservoirSample runs v's `sample: {method: reservoir}` Algorithm R
+// pass once, over every matching row's ctid rather than its full data, and
+// pins the ctids it kept the same way pinRandomSample pins a random
+// sample's. Without this, collectReferencedValues (see
+// buildReferentialClosures) would compute a referencing child's FK closure
+// from every matching row instead of the ~size rows actually kept when the
+// child itself is dumped, and a second independent Algorithm R pass at dump
+// time would draw a different ~size rows anyway.
+func pinReservoirSample(db *pg.DB, v *ManifestItem) (string, error) {
+	sql := fmt.Sprintf("SELECT ctid::text AS ctid FROM %s", v.Table)
+	if v.Where != "" {
+		sql += fmt.Sprintf(" WHERE %s", v.Where)
+	}
+
+	var kept ctidCollector
+	sampler := &reservoirSampler{size: v.Sample.Size, out: &kept}
+	if _, err := db.CopyTo(sampler, fmt.Sprintf(`COPY (%s) TO STDOUT`, sql)); err != nil {
+		return "", err
+	}
+	if err := sampler.Flush(); err != nil {
+		return "", err
+	}
+
+	return pinnedSource(v.Table, kept.ctids), nil
+}
+
+// ctidCollector is the io.Writer a reservoirSampler drains into in
+// pinReservoirSample: each kept COPY line is a single ctid field, decoded
+// and collected rather than written on to a dump.
+type ctidCollector struct {
+	ctids []string
+}
+
+func (c *ctidCollector) Write(p []byte) (int, error) {
+	value, _ := decodeCopyField(strings.TrimSuffix(string(p), "\n"))
+	c.ctids = append(c.ctids, value)
+	return len(p), nil
+}
+
+// sampleCache memoizes the row source resolved for each table by
+// pinRandomSample or pinReservoirSample, keyed by table name, so a dependency level's worker
+// goroutines in makeDumpParallel can resolve the same table's source
+// concurrently without racing or re-sampling it.
+type sampleCache struct {
+	mu       sync.Mutex
+	resolved map[string]string
+}
+
+func newSampleCache() *sampleCache {
+	return &sampleCache{resolved: make(map[string]string)}
+}
+
+func (c *sampleCache) resolve(table string, build func() (string, error)) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if source, ok := c.resolved[table]; ok {
+		return source, nil
+	}
+	source, err := build()
+	if err != nil {
+		return "", err
+	}
+	c.resolved[table] = source
+	return source, nil
+}
+
+func isRandomSample(s *SampleSpec) bool {
+	return s != nil && s.Method == "random" && s.Size > 0
+}
+
+func isReservoirSample(s *SampleSpec) bool {
+	return s != nil && s.Method == "reservoir" && s.Size > 0
+}
+
+// flusher is implemented by writers in the dump pipeline (transformWriter,
+// copyRowReader, reservoirSampler) that buffer a trailing partial line and
+// must be drained once pg.CopyTo returns.
+type flusher interface {
+	Flush() error
+}
+
+func flushWriter(w io.Writer) error {
+	if f, ok := w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// wrapReservoir interposes a reservoirSampler in front of dest when the
+// manifest item asks for reservoir sampling, otherwise it returns dest
+// unchanged.
+func wrapReservoir(dest io.Writer, sample *SampleSpec) io.Writer {
+	if !isReservoirSample(sample) {
+		return dest
+	}
+	return &reservoirSampler{size: sample.Size, out: dest}
+}
+
+// dumpRows is the shared decode+transform+sample pipeline behind every
+// non-copy formatter (insert, csv, jsonl) and the migration INSERT writer:
+// it runs `COPY source TO STDOUT` over db, decodes each line, applies v's
+// transforms and optional reservoir sampling, and invokes onRow once per
+// resulting row.
+func dumpRows(db *pg.DB, v *ManifestItem, source string, columns []string, onRow func(values []string, nulls []bool) error) error {
+	transforms, err := buildTransforms(v.Transforms)
+	if err != nil {
+		return err
+	}
+
+	reader := &copyRowReader{onRow: func(values []string, nulls []bool) error {
+		applyTransformRow(columns, transforms, v.Deterministic, values, nulls)
+		return onRow(values, nulls)
+	}}
+
+	dest := wrapReservoir(reader, v.Sample)
+	sql := fmt.Sprintf(`COPY %s TO STDOUT`, source)
+	if _, err := db.CopyTo(dest, sql); err != nil {
+		return err
+	}
+	return flushWriter(dest)
+}
+
+// reservoirSampler retains a uniform random sample of at most size COPY
+// text lines using Algorithm R (Vitter), so arbitrarily large tables can be
+// sampled in one streaming pass without buffering the whole result set.
+// Sampled lines are forwarded to out once Flush is called; their relative
+// order is not preserved.
+type reservoirSampler struct {
+	size int
+	out  io.Writer
+	buf  bytes.Buffer
+	kept []string
+	seen int
+}
+
+func (r *reservoirSampler) Write(p []byte) (int, error) {
+	r.buf.Write(p)
+	for {
+		data := r.buf.Bytes()
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			break
+		}
+		r.keep(string(r.buf.Next(idx + 1)))
+	}
+	return len(p), nil
+}
+
+func (r *reservoirSampler) keep(line string) {
+	r.seen++
+	if len(r.kept) < r.size {
+		r.kept = append(r.kept, line)
+		return
+	}
+	if j := globalRand.Intn(r.seen); j < r.size {
+		r.kept[j] = line
+	}
+}
+
+func (r *reservoirSampler) Flush() error {
+	if r.buf.Len() > 0 {
+		r.keep(r.buf.String())
+		r.buf.Reset()
+	}
+
+	for _, line := range r.kept {
+		if _, err := r.out.Write([]byte(line)); err != nil {
+			return err
+		}
+	}
+	return flushWriter(r.out)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	pg "gopkg.in/pg.v4"
+)
+
+// Schema dump modes, selected via the --schema flag or a manifest-level
+// `schema:` entry.
+const (
+	SchemaNone = "none" // data only, the original behavior
+	SchemaPre  = "pre"  // DDL before the data, sequence restarts after
+	SchemaOnly = "only" // DDL and sequence restarts, no data
+)
+
+type tableColumn struct {
+	Colname    string
+	Coltype    string
+	Notnull    bool
+	Coldefault *string
+}
+
+func getTableColumnDefs(db *pg.DB, table string) ([]tableColumn, error) {
+	var model []tableColumn
+	sql := `
+		SELECT
+			a.attname AS colname,
+			pg_catalog.format_type(a.atttypid, a.atttypmod) AS coltype,
+			a.attnotnull AS notnull,
+			pg_catalog.pg_get_expr(d.adbin, d.adrelid) AS coldefault
+		FROM pg_catalog.pg_attribute a
+		LEFT JOIN pg_catalog.pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE
+			a.attrelid = ?::regclass
+			AND a.attnum > 0
+			AND a.attisdropped = FALSE
+			ORDER BY a.attnum
+	`
+	_, err := db.Query(&model, sql, table)
+	if err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+func getColumnSequence(db *pg.DB, table string, column string) (string, error) {
+	var model []struct {
+		Seqname *string
+	}
+	sql := `SELECT pg_get_serial_sequence(?, ?) AS seqname`
+	_, err := db.Query(&model, sql, table, column)
+	if err != nil {
+		return "", err
+	}
+	if len(model) == 0 || model[0].Seqname == nil {
+		return "", nil
+	}
+	return *model[0].Seqname, nil
+}
+
+func getTablePrimaryKeyDef(db *pg.DB, table string) (string, error) {
+	var model []struct {
+		Condef string
+	}
+	sql := `
+		SELECT pg_get_constraintdef(oid) AS condef
+		FROM pg_catalog.pg_constraint
+		WHERE conrelid = ?::regclass AND contype = 'p'
+	`
+	_, err := db.Query(&model, sql, table)
+	if err != nil {
+		return "", err
+	}
+	if len(model) == 0 {
+		return "", nil
+	}
+	return model[0].Condef, nil
+}
+
+func getTableIndexDefs(db *pg.DB, table string) ([]string, error) {
+	var model []struct {
+		Indexdef string
+	}
+	sql := `
+		SELECT pg_get_indexdef(indexrelid) AS indexdef
+		FROM pg_catalog.pg_index
+		WHERE indrelid = ?::regclass AND indisprimary = FALSE
+	`
+	_, err := db.Query(&model, sql, table)
+	if err != nil {
+		return nil, err
+	}
+
+	defs := make([]string, 0, len(model))
+	for _, v := range model {
+		defs = append(defs, v.Indexdef)
+	}
+	return defs, nil
+}
+
+// dumpSchema emits CREATE SEQUENCE/TABLE/INDEX DDL for the given tables, in
+// dependency order, so the dump can be loaded into an empty database.
+func dumpSchema(w io.Writer, db *pg.DB, tables []string) error {
+	tableCols := make(map[string][]tableColumn)
+	seqs := make([]string, 0)
+	seenSeq := make(map[string]bool)
+
+	for _, table := range tables {
+		cols, err := getTableColumnDefs(db, table)
+		if err != nil {
+			return err
+		}
+		tableCols[table] = cols
+
+		for _, col := range cols {
+			if col.Coldefault == nil {
+				continue
+			}
+			seq, err := getColumnSequence(db, table, col.Colname)
+			if err != nil {
+				return err
+			}
+			if seq == "" || seenSeq[seq] {
+				continue
+			}
+			seenSeq[seq] = true
+			seqs = append(seqs, seq)
+		}
+	}
+
+	for _, seq := range seqs {
+		dumpSqlCmd(w, fmt.Sprintf("CREATE SEQUENCE IF NOT EXISTS %s", seq))
+	}
+
+	for _, table := range tables {
+		defs := make([]string, 0, len(tableCols[table]))
+		for _, col := range tableCols[table] {
+			def := fmt.Sprintf("%s %s", strconv.Quote(col.Colname), col.Coltype)
+			if col.Notnull {
+				def += " NOT NULL"
+			}
+			if col.Coldefault != nil {
+				def += " DEFAULT " + *col.Coldefault
+			}
+			defs = append(defs, def)
+		}
+		fmt.Fprintf(w, "\nCREATE TABLE IF NOT EXISTS %s (\n\t%s\n);\n", table, strings.Join(defs, ",\n\t"))
+
+		pk, err := getTablePrimaryKeyDef(db, table)
+		if err != nil {
+			return err
+		}
+		if pk != "" {
+			dumpSqlCmd(w, fmt.Sprintf("ALTER TABLE %s ADD %s", table, pk))
+		}
+
+		idxDefs, err := getTableIndexDefs(db, table)
+		if err != nil {
+			return err
+		}
+		for _, idx := range idxDefs {
+			dumpSqlCmd(w, idx)
+		}
+	}
+
+	return nil
+}
+
+// dumpSequenceRestarts emits a setval() call for every sequence owned by a
+// dumped column, advancing it past the highest value loaded so that
+// subsequent inserts into the freshly loaded database don't collide.
+func dumpSequenceRestarts(w io.Writer, db *pg.DB, tables []string) error {
+	for _, table := range tables {
+		cols, err := getTableColumnDefs(db, table)
+		if err != nil {
+			return err
+		}
+
+		for _, col := range cols {
+			if col.Coldefault == nil {
+				continue
+			}
+			seq, err := getColumnSequence(db, table, col.Colname)
+			if err != nil {
+				return err
+			}
+			if seq == "" {
+				continue
+			}
+			dumpSqlCmd(w, fmt.Sprintf(
+				"SELECT setval('%s', (SELECT COALESCE(MAX(%s), 0) FROM %s))",
+				seq, strconv.Quote(col.Colname), table,
+			))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// randSource is the subset of *rand.Rand that transforms need. It lets
+// globalRand (shared, and so guarded by a mutex) and the per-value source
+// returned by Transform.rand (unshared, and so lock-free) be used
+// interchangeably.
+type randSource interface {
+	Intn(n int) int
+	Read(p []byte) (int, error)
+}
+
+// globalRand drives non-deterministic transforms and reservoir sampling
+// (see reservoirSampler.keep). Deterministic transforms use their own
+// per-value source instead, see Transform.rand. *rand.Rand isn't safe for
+// concurrent use, and makeDumpParallel dumps multiple tables at once, so
+// access is serialized through lockedRand.
+var globalRand randSource = &lockedRand{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// lockedRand wraps a *rand.Rand with a mutex so it can be shared as
+// globalRand across makeDumpParallel's worker goroutines.
+type lockedRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rng.Intn(n)
+}
+
+func (l *lockedRand) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rng.Read(p)
+}
+
+// Transform rewrites a single column value before it is written out, e.g.
+// to replace PII with fake or masked data. The zero value is never used
+// directly; transforms are always built by parseTransform.
+type Transform struct {
+	kind       string // "null", "const", "faker", "hash", "mask"
+	faker      string // name, email, phone, uuid
+	hashAlgo   string
+	hashSalt   string
+	mask       string
+	constValue string
+}
+
+// parseTransform parses a transform spec from a manifest `transforms` entry,
+// e.g. "faker.email", "hash(sha256, somesalt)", `mask("XXX-##")`, "null" or
+// "const:redacted".
+func parseTransform(spec string) (*Transform, error) {
+	switch {
+	case spec == "null":
+		return &Transform{kind: "null"}, nil
+
+	case strings.HasPrefix(spec, "const:"):
+		return &Transform{kind: "const", constValue: strings.TrimPrefix(spec, "const:")}, nil
+
+	case strings.HasPrefix(spec, "faker."):
+		name := strings.TrimPrefix(spec, "faker.")
+		switch name {
+		case "name", "email", "phone", "uuid":
+			return &Transform{kind: "faker", faker: name}, nil
+		default:
+			return nil, fmt.Errorf("unknown faker transform %q", spec)
+		}
+
+	case strings.HasPrefix(spec, "hash(") && strings.HasSuffix(spec, ")"):
+		args := splitArgs(spec[len("hash(") : len(spec)-1])
+		if len(args) == 0 || args[0] != "sha256" {
+			return nil, fmt.Errorf("unsupported hash algorithm in transform %q", spec)
+		}
+		salt := ""
+		if len(args) > 1 {
+			salt = args[1]
+		}
+		return &Transform{kind: "hash", hashAlgo: args[0], hashSalt: salt}, nil
+
+	case strings.HasPrefix(spec, "mask(") && strings.HasSuffix(spec, ")"):
+		pattern := strings.Trim(strings.TrimSpace(spec[len("mask("):len(spec)-1]), `"`)
+		return &Transform{kind: "mask", mask: pattern}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown transform %q", spec)
+	}
+}
+
+func splitArgs(s string) []string {
+	parts := strings.Split(s, ",")
+	for i, p := range parts {
+		parts[i] = strings.TrimSpace(p)
+	}
+	return parts
+}
+
+// Apply returns the replacement value for a column. isNull indicates the
+// original COPY field was SQL NULL (`\N`); transforms other than "null"
+// leave nulls untouched so foreign keys and optional columns keep working.
+// When deterministic is true the same original value always yields the
+// same replacement, which keeps pseudonymized foreign keys joinable.
+func (t *Transform) Apply(value string, isNull bool, deterministic bool) (string, bool) {
+	if isNull && t.kind != "null" {
+		return "", true
+	}
+
+	rng := globalRand
+	if deterministic {
+		rng = t.rand(value)
+	}
+
+	switch t.kind {
+	case "null":
+		return "", true
+	case "const":
+		return t.constValue, false
+	case "faker":
+		return fakeValue(t.faker, rng), false
+	case "hash":
+		sum := sha256.Sum256([]byte(t.hashSalt + value))
+		return hex.EncodeToString(sum[:]), false
+	case "mask":
+		return applyMask(t.mask, rng), false
+	default:
+		return value, false
+	}
+}
+
+func (t *Transform) rand(value string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+var fakeFirstNames = []string{"James", "Mary", "Robert", "Patricia", "John", "Linda", "Michael", "Barbara", "David", "Susan"}
+var fakeLastNames = []string{"Smith", "Johnson", "Williams", "Brown", "Jones", "Garcia", "Miller", "Davis", "Rodriguez", "Martinez"}
+var fakeDomains = []string{"example.com", "example.org", "example.net", "mail.test"}
+
+func fakeValue(kind string, rng randSource) string {
+	switch kind {
+	case "name":
+		return fmt.Sprintf("%s %s", fakeFirstNames[rng.Intn(len(fakeFirstNames))], fakeLastNames[rng.Intn(len(fakeLastNames))])
+	case "email":
+		return fmt.Sprintf("user%d@%s", rng.Intn(1000000), fakeDomains[rng.Intn(len(fakeDomains))])
+	case "phone":
+		return fmt.Sprintf("+1-555-%03d-%04d", rng.Intn(1000), rng.Intn(10000))
+	case "uuid":
+		b := make([]byte, 16)
+		rng.Read(b)
+		b[6] = (b[6] & 0x0f) | 0x40
+		b[8] = (b[8] & 0x3f) | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	default:
+		return ""
+	}
+}
+
+// applyMask renders a mask pattern like "XXX-##" where X is a random
+// uppercase letter, # is a random digit, and any other rune is copied
+// through literally.
+func applyMask(pattern string, rng randSource) string {
+	var buf bytes.Buffer
+	for _, r := range pattern {
+		switch r {
+		case 'X':
+			buf.WriteByte(byte('A' + rng.Intn(26)))
+		case '#':
+			buf.WriteByte(byte('0' + rng.Intn(10)))
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// buildTransforms parses a manifest item's `transforms` map into Transforms
+// keyed by column name.
+func buildTransforms(specs map[string]string) (map[string]*Transform, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	parsed := make(map[string]*Transform, len(specs))
+	for col, spec := range specs {
+		t, err := parseTransform(spec)
+		if err != nil {
+			return nil, err
+		}
+		parsed[col] = t
+	}
+	return parsed, nil
+}
+
+// applyTransformRow rewrites a decoded row in place according to the given
+// per-column transforms.
+func applyTransformRow(columns []string, transforms map[string]*Transform, deterministic bool, values []string, nulls []bool) {
+	for i, col := range columns {
+		if i >= len(values) {
+			break
+		}
+		t, ok := transforms[col]
+		if !ok {
+			continue
+		}
+		values[i], nulls[i] = t.Apply(values[i], nulls[i], deterministic)
+	}
+}
+
+// decodeCopyField unescapes a single tab-delimited COPY text field,
+// returning the value and whether it was SQL NULL (`\N`).
+func decodeCopyField(field string) (string, bool) {
+	if field == `\N` {
+		return "", true
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(field); i++ {
+		if field[i] != '\\' || i == len(field)-1 {
+			buf.WriteByte(field[i])
+			continue
+		}
+		i++
+		switch field[i] {
+		case 'N':
+			buf.WriteByte('\\')
+			buf.WriteByte('N')
+		case 't':
+			buf.WriteByte('\t')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case '\\':
+			buf.WriteByte('\\')
+		default:
+			buf.WriteByte('\\')
+			buf.WriteByte(field[i])
+		}
+	}
+	return buf.String(), false
+}
+
+// encodeCopyField is the inverse of decodeCopyField.
+func encodeCopyField(value string, isNull bool) string {
+	if isNull {
+		return `\N`
+	}
+
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		"\t", `\t`,
+		"\n", `\n`,
+		"\r", `\r`,
+	)
+	return replacer.Replace(value)
+}
+
+// transformWriter sits between pg.CopyTo and the dump output, decoding each
+// COPY text line into fields, applying the configured per-column transforms
+// and re-encoding the line before it is written out.
+type transformWriter struct {
+	w             io.Writer
+	columns       []string
+	transforms    map[string]*Transform
+	deterministic bool
+	buf           bytes.Buffer
+}
+
+func newTransformWriter(w io.Writer, columns []string, transforms map[string]*Transform, deterministic bool) *transformWriter {
+	return &transformWriter{w: w, columns: columns, transforms: transforms, deterministic: deterministic}
+}
+
+func (tw *transformWriter) Write(p []byte) (int, error) {
+	tw.buf.Write(p)
+	for {
+		data := tw.buf.Bytes()
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			break
+		}
+		line := tw.buf.Next(idx + 1)
+		if err := tw.writeLine(strings.TrimSuffix(string(line), "\n")); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes out any trailing partial line left in the buffer. It must be
+// called once after pg.CopyTo returns.
+func (tw *transformWriter) Flush() error {
+	if tw.buf.Len() == 0 {
+		return nil
+	}
+	line := tw.buf.String()
+	tw.buf.Reset()
+	return tw.writeLine(line)
+}
+
+func (tw *transformWriter) writeLine(line string) error {
+	fields := strings.Split(line, "\t")
+	values := make([]string, len(fields))
+	nulls := make([]bool, len(fields))
+	for i, field := range fields {
+		values[i], nulls[i] = decodeCopyField(field)
+	}
+
+	applyTransformRow(tw.columns, tw.transforms, tw.deterministic, values, nulls)
+
+	for i := range fields {
+		fields[i] = encodeCopyField(values[i], nulls[i])
+	}
+	_, err := fmt.Fprintf(tw.w, "%s\n", strings.Join(fields, "\t"))
+	return err
+}
+
+// copyRowReader is an io.Writer that decodes an incoming COPY text stream
+// into rows of decoded field values (strings plus NULL flags), invoking
+// onRow for each one. It lets
+// non-COPY formatters (INSERT, CSV, JSON Lines) reuse the same COPY TO
+// STDOUT stream that the copy format writes directly.
+type copyRowReader struct {
+	buf   bytes.Buffer
+	onRow func(values []string, nulls []bool) error
+}
+
+func (r *copyRowReader) Write(p []byte) (int, error) {
+	r.buf.Write(p)
+	for {
+		data := r.buf.Bytes()
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			break
+		}
+		line := r.buf.Next(idx + 1)
+		if err := r.processLine(strings.TrimSuffix(string(line), "\n")); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush processes any trailing partial line left in the buffer. It must be
+// called once after pg.CopyTo returns.
+func (r *copyRowReader) Flush() error {
+	if r.buf.Len() == 0 {
+		return nil
+	}
+	line := r.buf.String()
+	r.buf.Reset()
+	return r.processLine(line)
+}
+
+func (r *copyRowReader) processLine(line string) error {
+	fields := strings.Split(line, "\t")
+	values := make([]string, len(fields))
+	nulls := make([]bool, len(fields))
+	for i, f := range fields {
+		values[i], nulls[i] = decodeCopyField(f)
+	}
+	return r.onRow(values, nulls)
+}